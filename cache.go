@@ -0,0 +1,246 @@
+package mirrorfs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"bazil.org/fuse"
+)
+
+// dirCacheTime is the default TTL a cache entry lives before it is
+// considered stale and re-read from the mirror. Override it with
+// SetDirCacheTime before calling Mount.
+var dirCacheTime = 5 * time.Second
+
+// SetDirCacheTime overrides the TTL used for the directory entry cache.
+func SetDirCacheTime(d time.Duration) {
+	dirCacheTime = d
+}
+
+//===========================================================================
+// Directory Entry Cache
+//===========================================================================
+
+// cacheEntry holds whatever has been cached for a single node path: the
+// last Attr, the last ReadDirAll listing, or both.
+type cacheEntry struct {
+	expires time.Time
+	attr    *fuse.Attr
+	dirents []fuse.Dirent
+}
+
+// dirCache is a per-FileSystem cache of Attr and ReadDirAll results keyed
+// by Node.path, with a TTL.
+type dirCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*cacheEntry
+}
+
+func newDirCache(ttl time.Duration) *dirCache {
+	return &dirCache{ttl: ttl, entries: make(map[string]*cacheEntry)}
+}
+
+func (c *dirCache) lookup(path string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[path]
+	if !ok || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry
+}
+
+// attr returns the cached Attr for path, if any and not expired.
+func (c *dirCache) attr(path string) (fuse.Attr, bool) {
+	entry := c.lookup(path)
+	if entry == nil || entry.attr == nil {
+		return fuse.Attr{}, false
+	}
+	return *entry.attr, true
+}
+
+// dirents returns the cached ReadDirAll listing for path, if any and not
+// expired.
+func (c *dirCache) dirents(path string) ([]fuse.Dirent, bool) {
+	entry := c.lookup(path)
+	if entry == nil || entry.dirents == nil {
+		return nil, false
+	}
+	return entry.dirents, true
+}
+
+func (c *dirCache) entry(path string) *cacheEntry {
+	entry := c.entries[path]
+	if entry == nil {
+		entry = &cacheEntry{}
+		c.entries[path] = entry
+	}
+	entry.expires = time.Now().Add(c.ttl)
+	return entry
+}
+
+func (c *dirCache) storeAttr(path string, attr fuse.Attr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entry(path).attr = &attr
+}
+
+func (c *dirCache) storeDirents(path string, ents []fuse.Dirent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entry(path).dirents = ents
+}
+
+// paths returns a snapshot of every path currently cached.
+func (c *dirCache) paths() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	paths := make([]string, 0, len(c.entries))
+	for path := range c.entries {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// forget clears path, and anything cached beneath it, from the cache.
+func (c *dirCache) forget(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, path)
+	prefix := path + string(filepath.Separator)
+	for p := range c.entries {
+		if strings.HasPrefix(p, prefix) {
+			delete(c.entries, p)
+		}
+	}
+}
+
+func (c *dirCache) forgetAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*cacheEntry)
+}
+
+//===========================================================================
+// Kernel Invalidation
+//===========================================================================
+
+// ForgetPath drops path from the directory cache and, if the mounted
+// kernel supports it, asks it to drop its own dentry and inode caches for
+// the same path. Modeled after rclone's Dir.ForgetPath.
+func (fs *FileSystem) ForgetPath(relpath string) {
+	fs.cache.forget(relpath)
+	fs.invalidateKernel(relpath)
+}
+
+// ForgetAll clears the entire directory cache and invalidates every path
+// that was cached, modeled after rclone's Dir.ForgetAll.
+func (fs *FileSystem) ForgetAll() {
+	for _, path := range fs.cache.paths() {
+		fs.invalidateKernel(path)
+	}
+	fs.cache.forgetAll()
+}
+
+// invalidateKernel asks the kernel to drop its dentry for relpath from its
+// parent and its own cached attrs, if invalidation is supported and
+// enabled on this connection. This goes through the fs package's Server
+// rather than the raw *fuse.Conn: fuse.NodeID is an id the fs package
+// assigns sequentially per served Node and has nothing to do with the
+// mirror's backing inode numbers, so the only correct way to address a
+// node for invalidation is by the Node value itself.
+func (fs *FileSystem) invalidateKernel(relpath string) {
+	if fs.server == nil || !fs.invalidate {
+		return
+	}
+
+	node, _ := fs.makeNode(relpath)
+	if err := fs.server.InvalidateNodeData(node); err != nil {
+		debug("invalidate node %s: %s", relpath, err)
+	}
+
+	parent, _ := fs.makeNode(filepath.Dir(relpath))
+	name := filepath.Base(relpath)
+	if err := fs.server.InvalidateEntry(parent, name); err != nil {
+		debug("invalidate entry %s: %s", relpath, err)
+	}
+}
+
+//===========================================================================
+// External Change Watcher
+//===========================================================================
+
+// watch wires an fsnotify watcher on the mirror directory so that changes
+// made outside of the mount (e.g. by another process editing the backing
+// tree directly) forget the affected path instead of being served stale
+// out of the cache.
+func (fs *FileSystem) watch() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		warn("could not start mirror watcher: %s", err)
+		return
+	}
+	defer watcher.Close()
+
+	fs.watcherMu.Lock()
+	fs.watcher = watcher
+	fs.watcherMu.Unlock()
+	defer func() {
+		fs.watcherMu.Lock()
+		fs.watcher = nil
+		fs.watcherMu.Unlock()
+	}()
+
+	if err := filepath.Walk(fs.mirror, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	}); err != nil {
+		warn("could not watch mirror %s: %s", fs.mirror, err)
+		return
+	}
+
+	for event := range watcher.Events {
+		rel, err := filepath.Rel(fs.mirror, event.Name)
+		if err != nil {
+			continue
+		}
+
+		// The mirror holds ciphertext names when the encrypting overlay
+		// is enabled; decode every component back to plaintext so the
+		// forgotten path matches what Node.path actually uses. An event
+		// on a name that isn't ours (e.g. the overlay's own key config
+		// file) can't be translated, so it's ignored.
+		plainRel, ok := fs.decodePath(rel)
+		if !ok {
+			continue
+		}
+
+		relpath := filepath.Join(fs.mount, plainRel)
+		debug("mirror change %s on %s", event.Op, relpath)
+		fs.ForgetPath(relpath)
+
+		if event.Op&fsnotify.Create != 0 {
+			if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+				fs.watchDir(event.Name)
+			}
+		}
+
+		if event.Op&(fsnotify.Create|fsnotify.Remove) != 0 {
+			fs.ForgetPath(filepath.Dir(relpath))
+		}
+	}
+}
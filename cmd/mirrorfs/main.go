@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/urfave/cli"
@@ -34,6 +35,38 @@ func main() {
 					Value:  2,
 					EnvVar: "MIRRORFS_VERBOSITY",
 				},
+				cli.DurationFlag{
+					Name:   "dir-cache-time",
+					Usage:  "ttl for the directory entry and attr cache",
+					Value:  5 * time.Second,
+					EnvVar: "MIRRORFS_DIR_CACHE_TIME",
+				},
+				cli.BoolFlag{
+					Name:   "encrypt",
+					Usage:  "transparently encrypt file contents and names in the mirror",
+					EnvVar: "MIRRORFS_ENCRYPT",
+				},
+				cli.StringFlag{
+					Name:   "key-file",
+					Usage:  "file holding the passphrase that unlocks --encrypt's master key",
+					EnvVar: "MIRRORFS_KEY_FILE",
+				},
+				cli.UintFlag{
+					Name:   "max-readahead",
+					Usage:  "readahead hint passed to the kernel, in bytes",
+					Value:  1 << 20,
+					EnvVar: "MIRRORFS_MAX_READAHEAD",
+				},
+				cli.BoolFlag{
+					Name:   "allow-other",
+					Usage:  "allow access by users other than the one that mounted the fs",
+					EnvVar: "MIRRORFS_ALLOW_OTHER",
+				},
+				cli.BoolFlag{
+					Name:   "default-permissions",
+					Usage:  "let the kernel enforce permission bits before calling mirrorfs",
+					EnvVar: "MIRRORFS_DEFAULT_PERMISSIONS",
+				},
 			},
 		},
 	}
@@ -46,6 +79,14 @@ func mount(c *cli.Context) (err error) {
 	// Set the debug log level
 	verbose := c.Uint("verbosity")
 	fs.SetLogLevel(uint8(verbose))
+	fs.SetDirCacheTime(c.Duration("dir-cache-time"))
+
+	if c.Bool("encrypt") {
+		if c.String("key-file") == "" {
+			return cli.NewExitError("--encrypt requires --key-file", 1)
+		}
+		fs.SetEncryptKeyFile(c.String("key-file"))
+	}
 
 	// Mount the directory with the arguments
 	if c.NArg() != 2 {
@@ -53,7 +94,15 @@ func mount(c *cli.Context) (err error) {
 	}
 
 	args := c.Args()
-	if err := fs.Mount(args.Get(0), args.Get(1)); err != nil {
+	opts := fs.MountOptions{
+		Mount:              args.Get(0),
+		Mirror:             args.Get(1),
+		MaxReadahead:       uint32(c.Uint("max-readahead")),
+		AllowOther:         c.Bool("allow-other"),
+		DefaultPermissions: c.Bool("default-permissions"),
+	}
+
+	if err := fs.Mount(opts); err != nil {
 		return err
 	}
 
@@ -0,0 +1,110 @@
+// Package crypto implements mirrorfs' optional encrypting overlay, modeled
+// after the fusefrontend split in gocryptfs: file contents and filenames
+// are encrypted independently of one another between the mount and the
+// mirror directory, so the mirror holds nothing but ciphertext.
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// BlockSize is the size of a plaintext block sealed as a single AEAD unit.
+const BlockSize = 4096
+
+// overhead is how much a plaintext block grows once sealed, i.e. the size
+// of the AEAD authentication tag.
+const overhead = 16
+
+// CiphertextBlockSize is the on-disk size of one sealed block.
+const CiphertextBlockSize = BlockSize + overhead
+
+// headerSize is the size of the per-file random nonce prefix stored ahead
+// of the first ciphertext block.
+const headerSize = chacha20poly1305.NonceSize
+
+// Cipher seals and opens fixed-size content blocks with a per-file AEAD
+// keyed by the overlay's master key. Each block's nonce is derived from
+// the file's random header and the block's index, so no nonce is ever
+// reused within a file or across files.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher returns a Cipher keyed by key, the overlay's 32-byte master key.
+func NewCipher(key []byte) (*Cipher, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// NewHeader returns a fresh random per-file header for a newly-created
+// ciphertext file.
+func NewHeader() ([]byte, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(rand.Reader, header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// blockNonce derives the nonce for block within a file from that file's
+// header.
+func blockNonce(header []byte, block uint64) []byte {
+	nonce := make([]byte, headerSize)
+	copy(nonce, header)
+
+	var ctr [8]byte
+	binary.BigEndian.PutUint64(ctr[:], block)
+	for i, b := range ctr {
+		nonce[headerSize-8+i] ^= b
+	}
+	return nonce
+}
+
+// SealBlock encrypts one plaintext block of a file whose header is header.
+func (c *Cipher) SealBlock(header []byte, block uint64, plaintext []byte) []byte {
+	return c.aead.Seal(nil, blockNonce(header, block), plaintext, nil)
+}
+
+// OpenBlock decrypts one ciphertext block of a file whose header is header.
+func (c *Cipher) OpenBlock(header []byte, block uint64, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(nil, blockNonce(header, block), ciphertext, nil)
+}
+
+// PlainSize returns the plaintext size of a ciphertext file cipherSize
+// bytes long.
+func PlainSize(cipherSize int64) int64 {
+	if cipherSize <= headerSize {
+		return 0
+	}
+
+	body := cipherSize - headerSize
+	fullBlocks := body / CiphertextBlockSize
+	remainder := body % CiphertextBlockSize
+
+	size := fullBlocks * BlockSize
+	if remainder > 0 {
+		size += remainder - overhead
+	}
+	return size
+}
+
+// CipherSize returns the ciphertext size a file holding plainSize bytes of
+// plaintext occupies on disk.
+func CipherSize(plainSize int64) int64 {
+	fullBlocks := plainSize / BlockSize
+	remainder := plainSize % BlockSize
+
+	size := headerSize + fullBlocks*CiphertextBlockSize
+	if remainder > 0 {
+		size += remainder + overhead
+	}
+	return size
+}
@@ -0,0 +1,242 @@
+package crypto
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// File wraps an *os.File holding a ciphertext body behind a per-file
+// header, presenting a plaintext ReadAt/WriteAt view so it is a drop-in
+// replacement for *os.File in mirrorfs' Handle.
+type File struct {
+	mu     sync.Mutex
+	file   *os.File
+	cipher *Cipher
+	header []byte
+}
+
+// OpenFile opens (or creates) the ciphertext file at path. If the file is
+// empty (freshly created) it is given a new random header; otherwise its
+// existing header is read back so blocks decrypt correctly.
+func OpenFile(path string, flags int, mode os.FileMode, cipher *Cipher) (*File, error) {
+	file, err := os.OpenFile(path, flags, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	f := &File{file: file, cipher: cipher}
+	if info.Size() == 0 {
+		if f.header, err = NewHeader(); err != nil {
+			file.Close()
+			return nil, err
+		}
+		if _, err := file.WriteAt(f.header, 0); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+
+	f.header = make([]byte, headerSize)
+	if _, err := file.ReadAt(f.header, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Size returns the plaintext size of the file.
+func (f *File) Size() (int64, error) {
+	info, err := f.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return PlainSize(info.Size()), nil
+}
+
+// readBlock returns the plaintext of block, zero-padded to BlockSize if
+// the block is a hole or the file's final, partial block. A hole reads
+// back as either nothing (block sits past the ciphertext EOF) or a run
+// of zero bytes (block sits before EOF but was never written, e.g. after
+// a truncate-up or an out-of-order write) -- neither is valid ciphertext,
+// so both are reported as a zeroed plaintext block rather than passed to
+// the AEAD, which would otherwise fail authentication on a never-sealed
+// block.
+func (f *File) readBlock(block uint64) ([]byte, error) {
+	ciphertext := make([]byte, CiphertextBlockSize)
+	n, err := f.file.ReadAt(ciphertext, headerSize+int64(block)*CiphertextBlockSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n <= overhead || isZero(ciphertext[:n]) {
+		return make([]byte, BlockSize), nil
+	}
+
+	plaintext, err := f.cipher.OpenBlock(f.header, block, ciphertext[:n])
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) < BlockSize {
+		padded := make([]byte, BlockSize)
+		copy(padded, plaintext)
+		return padded, nil
+	}
+	return plaintext, nil
+}
+
+// isZero reports whether b is entirely zero bytes, the on-disk shape of a
+// sparse hole.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// writeBlock seals plaintext (which may be shorter than BlockSize, for the
+// file's final block) as block and writes it to the ciphertext file.
+func (f *File) writeBlock(block uint64, plaintext []byte) error {
+	ciphertext := f.cipher.SealBlock(f.header, block, plaintext)
+	_, err := f.file.WriteAt(ciphertext, headerSize+int64(block)*CiphertextBlockSize)
+	return err
+}
+
+// ReadAt implements io.ReaderAt over the plaintext view of the file.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	size, err := f.Size()
+	if err != nil {
+		return 0, err
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+	var eof error
+	if end := off + int64(len(p)); end > size {
+		p = p[:size-off]
+		eof = io.EOF
+	}
+
+	read := 0
+	for read < len(p) {
+		block := uint64((off + int64(read)) / BlockSize)
+		blockOff := int((off + int64(read)) % BlockSize)
+
+		plaintext, err := f.readBlock(block)
+		if err != nil {
+			return read, err
+		}
+		read += copy(p[read:], plaintext[blockOff:])
+	}
+
+	return read, eof
+}
+
+// WriteAt implements io.WriterAt over the plaintext view of the file,
+// read-modify-writing whole ciphertext blocks whenever the write doesn't
+// land on a block boundary.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	size, err := f.Size()
+	if err != nil {
+		return 0, err
+	}
+	newSize := size
+	if end := off + int64(len(p)); end > newSize {
+		newSize = end
+	}
+
+	written := 0
+	for written < len(p) {
+		block := uint64((off + int64(written)) / BlockSize)
+		blockOff := int((off + int64(written)) % BlockSize)
+
+		plaintext, err := f.readBlock(block)
+		if err != nil {
+			return written, err
+		}
+		n := copy(plaintext[blockOff:], p[written:])
+
+		blockLen := BlockSize
+		if blockEnd := int64(block)*BlockSize + BlockSize; blockEnd > newSize {
+			blockLen = int(newSize - int64(block)*BlockSize)
+		}
+		if err := f.writeBlock(block, plaintext[:blockLen]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+
+	return written, nil
+}
+
+// Truncate changes the plaintext size of the file, re-sealing the block
+// that straddles the new boundary so its AEAD tag stays valid rather than
+// just truncating the raw ciphertext bytes.
+func (f *File) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	oldSize, err := f.Size()
+	if err != nil {
+		return err
+	}
+
+	block := uint64(size / BlockSize)
+	rem := int(size % BlockSize)
+
+	// Growing past the old EOF can leave the block that used to be the
+	// file's last (partial) block sealed at less than BlockSize even
+	// though it's now an interior block. Re-seal it at full length so a
+	// later read or shrink doesn't try to open an undersized ciphertext
+	// block and fail authentication.
+	if size > oldSize {
+		oldBlock := uint64(oldSize / BlockSize)
+		if oldSize%BlockSize != 0 && oldBlock < block {
+			plaintext, err := f.readBlock(oldBlock)
+			if err != nil {
+				return err
+			}
+			if err := f.writeBlock(oldBlock, plaintext); err != nil {
+				return err
+			}
+		}
+	}
+
+	cipherSize := headerSize + int64(block)*CiphertextBlockSize
+	if rem > 0 {
+		plaintext, err := f.readBlock(block)
+		if err != nil {
+			return err
+		}
+		if err := f.writeBlock(block, plaintext[:rem]); err != nil {
+			return err
+		}
+		cipherSize += int64(rem) + overhead
+	}
+
+	return f.file.Truncate(cipherSize)
+}
+
+// Sync flushes the underlying ciphertext file to disk.
+func (f *File) Sync() error {
+	return f.file.Sync()
+}
+
+// Close closes the underlying ciphertext file.
+func (f *File) Close() error {
+	return f.file.Close()
+}
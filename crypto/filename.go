@@ -0,0 +1,67 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+)
+
+// filenameEncoding is used instead of base64.URLEncoding so encrypted
+// names never contain '=' padding, which some tools balk at in path
+// components.
+var filenameEncoding = base64.URLEncoding.WithPadding(base64.NoPadding)
+
+// FilenameCipher encrypts and decrypts individual path components with
+// AES-SIV (RFC 5297). SIV is deterministic, so the same plaintext name
+// always encrypts to the same ciphertext without needing a stored nonce,
+// which keeps Lookup a pure function of the parent directory and name.
+type FilenameCipher struct {
+	aead *sivAEAD
+}
+
+// NewFilenameCipher returns a FilenameCipher keyed by key, the overlay's
+// 32-byte master key.
+func NewFilenameCipher(key []byte) (*FilenameCipher, error) {
+	aead, err := newSIV(key)
+	if err != nil {
+		return nil, err
+	}
+	return &FilenameCipher{aead: aead}, nil
+}
+
+// Encrypt returns the ciphertext, base64url-encoded name that name maps to
+// on the mirror.
+func (f *FilenameCipher) Encrypt(name string) string {
+	ciphertext := f.aead.Seal(nil, nil, []byte(name), nil)
+	return filenameEncoding.EncodeToString(ciphertext)
+}
+
+// Decrypt reverses Encrypt, returning an error if name isn't a ciphertext
+// this cipher produced (e.g. a plaintext file dropped directly in the
+// mirror, or mirrorfs' own key config).
+func (f *FilenameCipher) Decrypt(name string) (string, error) {
+	ciphertext, err := filenameEncoding.DecodeString(name)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := f.aead.Open(nil, nil, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// EncryptPath encrypts each component of rel in turn, joining the results
+// back into a single relative path.
+func (f *FilenameCipher) EncryptPath(rel string) string {
+	if rel == "." || rel == "" {
+		return rel
+	}
+
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i, part := range parts {
+		parts[i] = f.Encrypt(part)
+	}
+	return filepath.Join(parts...)
+}
@@ -0,0 +1,181 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ConfigName is the file mirrorfs creates at the mirror root to hold the
+// encrypted master key the first time --encrypt is used against it.
+const ConfigName = ".mirrorfs.conf"
+
+// Scrypt parameters for deriving the key-encryption-key from the user's
+// passphrase. N=2^16 costs roughly 100ms on modern hardware.
+const (
+	scryptN      = 1 << 16
+	scryptR      = 8
+	scryptP      = 1
+	masterKeyLen = 32 // AES-256/ChaCha20-Poly1305 key size
+	saltLen      = 16
+)
+
+// config is the on-disk JSON structure holding everything needed to
+// recover the master key given the passphrase.
+type config struct {
+	Salt         []byte `json:"salt"`
+	Nonce        []byte `json:"nonce"`
+	EncryptedKey []byte `json:"encrypted_key"`
+}
+
+// Overlay bundles the content and filename ciphers for a single unlocked
+// mirror; a nil *Overlay on a FileSystem means plain mirror mode.
+type Overlay struct {
+	Content  *Cipher
+	Filename *FilenameCipher
+}
+
+// Unlock derives the key-encryption-key from passphrase and recovers the
+// overlay's master key from the config file at the mirror root, creating
+// both if this is the first time --encrypt has been used against mirror.
+func Unlock(mirror string, passphrase []byte) (*Overlay, error) {
+	path := filepath.Join(mirror, ConfigName)
+
+	raw, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return create(path, passphrase)
+	case err != nil:
+		return nil, err
+	}
+
+	var cfg config
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, err
+	}
+
+	kek, err := deriveKEK(passphrase, cfg.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	masterKey, err := unwrapKey(kek, cfg.Nonce, cfg.EncryptedKey)
+	if err != nil {
+		return nil, errors.New("crypto: incorrect key file or corrupt config")
+	}
+
+	return newOverlay(masterKey)
+}
+
+// create generates a fresh random master key, wraps it with a KEK derived
+// from passphrase, and writes the result to path as the mirror's config.
+func create(path string, passphrase []byte) (*Overlay, error) {
+	masterKey := make([]byte, masterKeyLen)
+	if _, err := io.ReadFull(rand.Reader, masterKey); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, saltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	kek, err := deriveKEK(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, encryptedKey, err := wrapKey(kek, masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := json.Marshal(config{Salt: salt, Nonce: nonce, EncryptedKey: encryptedKey})
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, raw, 0600); err != nil {
+		return nil, err
+	}
+
+	return newOverlay(masterKey)
+}
+
+// deriveKEK stretches passphrase and salt into a key-encryption-key.
+func deriveKEK(passphrase, salt []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, masterKeyLen)
+}
+
+// wrapKey seals masterKey under kek, returning the nonce used alongside
+// the ciphertext.
+func wrapKey(kek, masterKey []byte) (nonce, encryptedKey []byte, err error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce = make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return nonce, gcm.Seal(nil, nonce, masterKey, nil), nil
+}
+
+// unwrapKey reverses wrapKey.
+func unwrapKey(kek, nonce, encryptedKey []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Open(nil, nonce, encryptedKey, nil)
+}
+
+// newOverlay builds the content and filename ciphers from masterKey.
+func newOverlay(masterKey []byte) (*Overlay, error) {
+	content, err := NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	filename, err := NewFilenameCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Overlay{Content: content, Filename: filename}, nil
+}
+
+// OpenFile opens path for plaintext content I/O through the overlay's
+// block cipher.
+func (o *Overlay) OpenFile(path string, flags int, mode os.FileMode) (*File, error) {
+	return OpenFile(path, flags, mode, o.Content)
+}
+
+// Truncate changes the plaintext size of the file at path.
+func (o *Overlay) Truncate(path string, size int64) error {
+	file, err := OpenFile(path, os.O_RDWR, 0, o.Content)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Truncate(size)
+}
@@ -0,0 +1,187 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+// sivTagSize is the size of the synthetic IV S2V produces, and of the
+// CMAC used to build it -- one AES block.
+const sivTagSize = aes.BlockSize
+
+// sivAEAD implements AEAD_AES_SIV_CMAC_256 (RFC 5297), keyed by a pair of
+// AES-128 keys packed into one 32-byte key: the first half for the S2V
+// MAC, the second for CTR encryption. There's nothing on the module
+// proxy that implements RFC 5297 against this key size, so it's
+// hand-rolled here on top of crypto/aes and crypto/cipher rather than
+// pulled in as a dependency.
+type sivAEAD struct {
+	macBlock cipher.Block
+	ctrBlock cipher.Block
+}
+
+// newSIV returns a sivAEAD keyed by key, which must be 32 bytes.
+func newSIV(key []byte) (*sivAEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("crypto: AES-SIV key must be 32 bytes")
+	}
+
+	macBlock, err := aes.NewCipher(key[:16])
+	if err != nil {
+		return nil, err
+	}
+	ctrBlock, err := aes.NewCipher(key[16:])
+	if err != nil {
+		return nil, err
+	}
+	return &sivAEAD{macBlock: macBlock, ctrBlock: ctrBlock}, nil
+}
+
+// Seal returns append(dst, V, ciphertext...), where V is the 16-byte
+// synthetic IV S2V derives from additionalData and plaintext.
+func (s *sivAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	v := s.s2v(additionalData, plaintext)
+
+	ciphertext := make([]byte, len(plaintext))
+	s.ctrStream(v).XORKeyStream(ciphertext, plaintext)
+
+	dst = append(dst, v...)
+	dst = append(dst, ciphertext...)
+	return dst
+}
+
+// Open reverses Seal, returning an error if in isn't a V||ciphertext pair
+// this AEAD produced.
+func (s *sivAEAD) Open(dst, nonce, in, additionalData []byte) ([]byte, error) {
+	if len(in) < sivTagSize {
+		return nil, errors.New("crypto: SIV ciphertext too short")
+	}
+	v, ciphertext := in[:sivTagSize], in[sivTagSize:]
+
+	plaintext := make([]byte, len(ciphertext))
+	s.ctrStream(v).XORKeyStream(plaintext, ciphertext)
+
+	if subtle.ConstantTimeCompare(s.s2v(additionalData, plaintext), v) != 1 {
+		return nil, errors.New("crypto: SIV authentication failed")
+	}
+	return append(dst, plaintext...), nil
+}
+
+// ctrStream builds the CTR keystream RFC 5297 uses to encrypt under the
+// synthetic IV v, with the top bit of its third and fourth 32-bit words
+// cleared so implementations that treat the IV as two 64-bit counters
+// never see a carry between them.
+func (s *sivAEAD) ctrStream(v []byte) cipher.Stream {
+	iv := make([]byte, sivTagSize)
+	copy(iv, v)
+	iv[8] &= 0x7f
+	iv[12] &= 0x7f
+	return cipher.NewCTR(s.ctrBlock, iv)
+}
+
+// s2v implements RFC 5297's S2V over the two strings mirrorfs ever needs:
+// an optional associated-data string and the (mandatory) plaintext.
+func (s *sivAEAD) s2v(ad, plaintext []byte) []byte {
+	d := cmac(s.macBlock, make([]byte, sivTagSize))
+
+	if len(ad) > 0 {
+		d = xor(dbl(d), cmac(s.macBlock, ad))
+	}
+
+	var t []byte
+	if len(plaintext) >= sivTagSize {
+		t = xorEnd(plaintext, d)
+	} else {
+		t = xor(dbl(d), pad(plaintext, sivTagSize))
+	}
+	return cmac(s.macBlock, t)
+}
+
+// cmac computes AES-CMAC (NIST SP 800-38B) of data under block.
+func cmac(block cipher.Block, data []byte) []byte {
+	bs := block.BlockSize()
+	k1, k2 := cmacSubkeys(block)
+
+	n := (len(data) + bs - 1) / bs
+	complete := n > 0 && len(data)%bs == 0
+	if n == 0 {
+		n = 1
+	}
+
+	last := make([]byte, bs)
+	if complete {
+		copy(last, data[(n-1)*bs:])
+		last = xor(last, k1)
+	} else {
+		copy(last, data[(n-1)*bs:])
+		last[len(data)-(n-1)*bs] = 0x80
+		last = xor(last, k2)
+	}
+
+	mac := make([]byte, bs)
+	for i := 0; i < n-1; i++ {
+		mac = xor(mac, data[i*bs:(i+1)*bs])
+		block.Encrypt(mac, mac)
+	}
+	mac = xor(mac, last)
+	block.Encrypt(mac, mac)
+	return mac
+}
+
+// cmacSubkeys derives CMAC's two subkeys from block, per NIST SP 800-38B.
+func cmacSubkeys(block cipher.Block) (k1, k2 []byte) {
+	zero := make([]byte, block.BlockSize())
+	l := make([]byte, block.BlockSize())
+	block.Encrypt(l, zero)
+
+	k1 = dbl(l)
+	k2 = dbl(k1)
+	return k1, k2
+}
+
+// dbl multiplies b, read as an element of GF(2^128), by x, reducing
+// modulo the polynomial x^128 + x^7 + x^2 + x + 1 on overflow.
+func dbl(b []byte) []byte {
+	out := make([]byte, len(b))
+	var carry byte
+	for i := len(b) - 1; i >= 0; i-- {
+		out[i] = (b[i] << 1) | carry
+		carry = b[i] >> 7
+	}
+	if b[0]&0x80 != 0 {
+		out[len(out)-1] ^= 0x87
+	}
+	return out
+}
+
+// xor returns the element-wise XOR of a and b, which must be equal length.
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range out {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// xorEnd XORs d into the last len(d) bytes of s, leaving the rest of s
+// untouched.
+func xorEnd(s, d []byte) []byte {
+	out := make([]byte, len(s))
+	copy(out, s)
+	tail := out[len(out)-len(d):]
+	for i := range tail {
+		tail[i] ^= d[i]
+	}
+	return out
+}
+
+// pad right-pads s to n bytes with a single 0x80 byte followed by zeros,
+// per the CMAC/S2V padding rule.
+func pad(s []byte, n int) []byte {
+	out := make([]byte, n)
+	copy(out, s)
+	out[len(s)] = 0x80
+	return out
+}
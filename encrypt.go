@@ -0,0 +1,68 @@
+package mirrorfs
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"bazil.org/fuse"
+
+	"github.com/bbengfort/mirrorfs/crypto"
+)
+
+//===========================================================================
+// Encrypting Overlay
+//===========================================================================
+
+// encryptKeyFile, set by SetEncryptKeyFile before Mount, opts into the
+// encrypting overlay and points it at the file holding the user's
+// passphrase. Left empty (the default), Mount runs in plain mirror mode
+// so existing deployments are unaffected.
+var encryptKeyFile string
+
+// SetEncryptKeyFile enables the encrypting overlay; Mount then reads the
+// passphrase that unlocks (or creates) its master key from keyFile. This
+// mirrors SetDirCacheTime's pattern of a package-level option set
+// before calling Mount.
+func SetEncryptKeyFile(keyFile string) {
+	encryptKeyFile = keyFile
+}
+
+// enableEncryption reads the passphrase from keyFile and unlocks the
+// overlay's master key from the config stored at the mirror root,
+// generating both on the first mount against a mirror.
+func (fs *FileSystem) enableEncryption(keyFile string) error {
+	passphrase, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	passphrase = []byte(strings.TrimSpace(string(passphrase)))
+
+	overlay, err := crypto.Unlock(fs.mirror, passphrase)
+	if err != nil {
+		return err
+	}
+
+	fs.overlay = overlay
+	return nil
+}
+
+// openContent opens path for content I/O, transparently sealing and
+// opening it through the encrypting overlay's block cipher when one is
+// configured.
+//
+// Handle writes always go through WriteAt at the offset the kernel
+// supplies, which *os.File refuses on a file opened O_APPEND, so O_APPEND
+// is not passed on to the mirror file. The overlay reads each block back
+// before re-sealing it, so a write-only open is opened read-write on the
+// mirror when the overlay is enabled.
+func (fs *FileSystem) openContent(path string, flags fuse.OpenFlags, mode os.FileMode) (contentFile, error) {
+	flags &^= fuse.OpenAppend
+	if fs.overlay == nil {
+		return os.OpenFile(path, int(flags), mode)
+	}
+	if flags.IsWriteOnly() {
+		flags = flags&^fuse.OpenAccessModeMask | fuse.OpenReadWrite
+	}
+	return fs.overlay.OpenFile(path, int(flags), mode)
+}
@@ -5,10 +5,16 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 
+	"github.com/fsnotify/fsnotify"
+
 	"bazil.org/fuse"
 	fusefs "bazil.org/fuse/fs"
+
+	"github.com/bbengfort/mirrorfs/crypto"
 )
 
 //===========================================================================
@@ -48,23 +54,69 @@ func signalHandler(mount string) {
 // Global Entry Point to FUSE mount
 //===========================================================================
 
-// Mount the mirror file system at the specified path, mirroring to the other
-// path. This returns an error if the mount point does not exist.
-func Mount(mount, mirror string) (err error) {
-	info("mounting %s to mirror %s", mount, mirror)
+// MountOptions configures a call to Mount. The zero value of every knob
+// below except Mount/Mirror falls back to the library default, so callers
+// that only care about the mount point and mirror directory can leave
+// them unset.
+type MountOptions struct {
+	Mount  string // Location of the mount point
+	Mirror string // Location to mirror operations to
+
+	MaxReadahead       uint32 // Readahead hint passed to the kernel; 0 uses the library default
+	AllowOther         bool   // Allow access by users other than the one that mounted the fs
+	DefaultPermissions bool   // Let the kernel enforce permission bits before calling us
+}
+
+// DefaultMountOptions returns the MountOptions MountDefault mounts with.
+func DefaultMountOptions(mount, mirror string) MountOptions {
+	return MountOptions{
+		Mount:        mount,
+		Mirror:       mirror,
+		MaxReadahead: 1 << 20,
+	}
+}
+
+// MountDefault mounts mount/mirror with DefaultMountOptions. It's a
+// compatibility shim for callers that don't need any of MountOptions'
+// newer knobs.
+func MountDefault(mount, mirror string) error {
+	return Mount(DefaultMountOptions(mount, mirror))
+}
+
+// Mount the mirror file system according to opts. This returns an error if
+// the mount point does not exist.
+func Mount(opts MountOptions) (err error) {
+	info("mounting %s to mirror %s", opts.Mount, opts.Mirror)
 
 	// Unmount the FS in case it was mounted with errors
-	fuse.Unmount(mount)
+	fuse.Unmount(opts.Mount)
 
 	// Mount the FS with the specified options.
-	fs := NewFS(mount, mirror, false)
-	conn, err := fuse.Mount(
-		mount,
+	fs := NewFS(opts.Mount, opts.Mirror, false)
+	if encryptKeyFile != "" {
+		if err := fs.enableEncryption(encryptKeyFile); err != nil {
+			return err
+		}
+		info("encrypting overlay enabled, mirror %s holds ciphertext only", opts.Mirror)
+	}
+
+	mountOpts := []fuse.MountOption{
 		fuse.FSName("MirrorFS"),
 		fuse.Subtype("mirrorfs"),
 		fuse.LocalVolume(),
 		fuse.VolumeName("Mirror Volume"),
-	)
+	}
+	if opts.MaxReadahead > 0 {
+		mountOpts = append(mountOpts, fuse.MaxReadahead(opts.MaxReadahead))
+	}
+	if opts.AllowOther {
+		mountOpts = append(mountOpts, fuse.AllowOther())
+	}
+	if opts.DefaultPermissions {
+		mountOpts = append(mountOpts, fuse.DefaultPermissions())
+	}
+
+	conn, err := fuse.Mount(opts.Mount, mountOpts...)
 	if err != nil {
 		return err
 	}
@@ -72,11 +124,25 @@ func Mount(mount, mirror string) (err error) {
 	// Ensure connection is closed when done
 	defer conn.Close()
 
+	// Hold onto the connection and the fs package's Server wrapping it so
+	// cache invalidations can be pushed to the kernel by Node value, but
+	// only if this kernel is new enough to support it.
+	fs.conn = conn
+	fs.server = fusefs.New(conn, nil)
+	if conn.Protocol().HasInvalidate() {
+		fs.invalidate = true
+	} else {
+		warn("kernel does not support invalidation, directory cache may go stale")
+	}
+
+	// Watch the mirror directory for out-of-band changes.
+	go fs.watch()
+
 	// Ensure that we unmount the file system when done
-	go signalHandler(mount)
+	go signalHandler(opts.Mount)
 
 	// Serve the file system.
-	if err := fusefs.Serve(conn, fs); err != nil {
+	if err := fs.server.Serve(fs); err != nil {
 		return err
 	}
 
@@ -103,23 +169,99 @@ func NewFS(mount, mirror string, abs bool) *FileSystem {
 	fs := new(FileSystem)
 	fs.mount = mount
 	fs.mirror = mirror
+	fs.cache = newDirCache(dirCacheTime)
+	fs.nodes = make(map[string]*Node)
 	fs.root, _ = fs.makeNode(fs.mount)
 	return fs
 }
 
 // FileSystem implements fusefs.FS* interfaces.
 type FileSystem struct {
-	mount  string // Location of the mount point
-	mirror string // Location to mirror operations to
-	root   *Node  // Node of the root directory
+	mount      string          // Location of the mount point
+	mirror     string          // Location to mirror operations to
+	root       *Node           // Node of the root directory
+	cache      *dirCache       // Directory entry and attr cache
+	conn       *fuse.Conn      // Connection to the kernel
+	server     *fusefs.Server  // Server wrapping conn, for invalidation by Node
+	invalidate bool            // Whether the kernel supports invalidation
+	overlay    *crypto.Overlay // Encrypting overlay; nil in plain mirror mode
+
+	nodesMu sync.Mutex       // Guards nodes
+	nodes   map[string]*Node // Live nodes by mount-relative path, for invalidation
+
+	watcherMu sync.Mutex        // Guards watcher
+	watcher   *fsnotify.Watcher // Mirror change watcher; nil until watch's goroutine starts it
 }
 
 // Root implements fusefs.FS
-func (fs FileSystem) Root() (fusefs.Node, error) {
+func (fs *FileSystem) Root() (fusefs.Node, error) {
 	return fs.root, nil
 }
 
-// create a node from a path relative to the mount directory.
+// create a node from a path relative to the mount directory. The same
+// *Node is returned for repeated calls with the same path, since the fs
+// package's Server tracks served nodes by value and invalidateKernel
+// needs to hand it back the exact Node it's already tracking.
 func (fs *FileSystem) makeNode(path string) (*Node, error) {
-	return &Node{path, fs, nil}, nil
+	fs.nodesMu.Lock()
+	defer fs.nodesMu.Unlock()
+
+	if node, ok := fs.nodes[path]; ok {
+		return node, nil
+	}
+
+	node := &Node{path, fs}
+	fs.nodes[path] = node
+	return node, nil
+}
+
+// decodeName translates a mirror-side file name back to the plaintext
+// name, or false if it isn't one of ours (e.g. the encrypting overlay's
+// own key config file sitting at the mirror root).
+func (fs *FileSystem) decodeName(raw string) (string, bool) {
+	if fs.overlay == nil {
+		return raw, true
+	}
+
+	plain, err := fs.overlay.Filename.Decrypt(raw)
+	if err != nil {
+		return "", false
+	}
+	return plain, true
+}
+
+// decodePath decodes each component of rel, a path relative to the
+// mirror directory, back to plaintext, or reports false if any component
+// isn't one of ours.
+func (fs *FileSystem) decodePath(rel string) (string, bool) {
+	if rel == "." || rel == "" {
+		return rel, true
+	}
+
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i, part := range parts {
+		name, ok := fs.decodeName(part)
+		if !ok {
+			return "", false
+		}
+		parts[i] = name
+	}
+	return filepath.Join(parts...), true
+}
+
+// watchDir registers path, a mirror-side directory, with the running
+// mirror change watcher so out-of-band changes under it get invalidated
+// too. It's a no-op if the watcher isn't running yet (e.g. a Mkdir that
+// races watch's own startup walk).
+func (fs *FileSystem) watchDir(path string) {
+	fs.watcherMu.Lock()
+	watcher := fs.watcher
+	fs.watcherMu.Unlock()
+
+	if watcher == nil {
+		return
+	}
+	if err := watcher.Add(path); err != nil {
+		debug("watch %s: %s", path, err)
+	}
 }
@@ -0,0 +1,116 @@
+package mirrorfs
+
+import (
+	"io"
+
+	"golang.org/x/net/context"
+
+	"bazil.org/fuse"
+)
+
+//===========================================================================
+// Open File Handles
+//===========================================================================
+
+// contentFile is the subset of *os.File a Handle needs to serve reads and
+// writes. It's satisfied directly by *os.File in plain mirror mode, and
+// by *crypto.File when the encrypting overlay is enabled, so Handle never
+// needs to know which mode it's in.
+type contentFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Close() error
+}
+
+// Handle owns an open contentFile together with the flags it was opened
+// with and a reference back to the Node it was opened from. Splitting
+// handles out of Node allows two concurrent opens of the same path to
+// each keep their own file descriptor and open flags rather than
+// stomping on each other through a single Node.file field.
+//
+// Handle doesn't track its own fuse.HandleID: bazil.org/fuse/fs assigns
+// and remembers one for every fs.Handle it serves and always overwrites
+// resp.Handle with that one, so a second ID here would just be dead
+// bookkeeping.
+type Handle struct {
+	node  *Node
+	file  contentFile
+	flags fuse.OpenFlags
+}
+
+//===========================================================================
+// Handle Methods
+//===========================================================================
+
+// Read implements fuse.HandleReader
+func (h *Handle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	trace("Read %s", h.node.path)
+
+	resp.Data = make([]byte, req.Size)
+	nbytes, err := h.file.ReadAt(resp.Data, req.Offset)
+	if err != nil {
+		if err != io.EOF {
+			return errno(err)
+		}
+
+		// Otherwise modify the response to the exact length
+		resp.Data = resp.Data[0:nbytes]
+	}
+
+	debug("read %d bytes from offest %d in %s", nbytes, req.Offset, h.node.path)
+	return nil
+}
+
+// Write implements fuse.HandleWriter
+func (h *Handle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	trace("Write %s", h.node.path)
+
+	// Write the data to the file
+	resp.Size, err = h.file.WriteAt(req.Data, req.Offset)
+	if err != nil {
+		return errno(err)
+	}
+
+	debug("wrote %d bytes offset by %d to %s", resp.Size, req.Offset, h.node.path)
+	return nil
+}
+
+// Fsync implements fuse.HandleFsyncer
+func (h *Handle) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	trace("Fsync %s", h.node.path)
+
+	// fsync tells the OS to flush its buffers to the physical media
+	if err := h.file.Sync(); err != nil {
+		return errno(err)
+	}
+	return nil
+}
+
+// Flush implments fuse.HandleFlusher
+func (h *Handle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	trace("Flush %s", h.node.path)
+
+	// flush the internal buffers of your application out to the OS
+	debug("flush not implemented as there are no internal buffers")
+	return nil
+}
+
+// Release implements fuse.HandleReleaser
+func (h *Handle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	trace("Release %s", h.node.path)
+
+	// Sync if the kernel asked for a flush on release, or if this handle
+	// was opened O_SYNC in the first place.
+	if req.ReleaseFlags == fuse.ReleaseFlush || h.flags&fuse.OpenSync != 0 {
+		if err := h.file.Sync(); err != nil {
+			caution(err.Error())
+		}
+	}
+
+	if err := h.file.Close(); err != nil {
+		caution(err.Error())
+	}
+
+	return nil
+}
@@ -2,7 +2,6 @@ package mirrorfs
 
 import (
 	"errors"
-	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -13,13 +12,16 @@ import (
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+
+	"github.com/bbengfort/mirrorfs/crypto"
 )
 
-// Node implements the fuse.Node methods.
+// Node implements the fuse.Node methods. Open files are separate *Handle
+// values, so a Node carries no file descriptor of its own. Handles are not
+// recorded on the FileSystem; only bazil.org/fuse/fs keeps track of them.
 type Node struct {
 	path string      // path to location relative to mountpoint and mirror.
 	fs   *FileSystem // reference to file system the node belongs to.
-	file *os.File    // handle to an open file for reads and writes.
 }
 
 //===========================================================================
@@ -27,14 +29,31 @@ type Node struct {
 //===========================================================================
 
 // Find the mirror path according to the mirror directory in the file system.
+// When the encrypting overlay is enabled, each path component is encrypted
+// before being joined onto the mirror directory, so the mirror never sees
+// a plaintext name.
 func (n *Node) mirrorPath() string {
 	rel, _ := filepath.Rel(n.fs.mount, n.path)
+	if n.fs.overlay != nil {
+		rel = n.fs.overlay.Filename.EncryptPath(rel)
+	}
 	return filepath.Join(n.fs.mirror, rel)
 }
 
-// Returns both the file info and the system stat for a node
+// childMirrorPath returns the mirror path of a not-yet-Node-wrapped child
+// of n by plaintext name, encrypting the name if the overlay is enabled.
+func (n *Node) childMirrorPath(name string) string {
+	if n.fs.overlay != nil {
+		name = n.fs.overlay.Filename.Encrypt(name)
+	}
+	return filepath.Join(n.mirrorPath(), name)
+}
+
+// Returns both the file info and the system stat for a node. Uses Lstat
+// rather than Stat so that symlinks report their own metadata rather than
+// the metadata of whatever they point to.
 func (n *Node) info() (os.FileInfo, *syscall.Stat_t, error) {
-	finfo, err := os.Stat(n.mirrorPath())
+	finfo, err := os.Lstat(n.mirrorPath())
 	if err != nil {
 		return nil, nil, err
 	}
@@ -53,32 +72,59 @@ func (n *Node) parent() *Node {
 // Common Node Methods
 //===========================================================================
 
+// buildAttr fills in a fuse.Attr from finfo/stat, translating the reported
+// size from ciphertext to plaintext when the encrypting overlay is
+// enabled.
+func (n *Node) buildAttr(finfo os.FileInfo, stat *syscall.Stat_t, now time.Time) fuse.Attr {
+	attr := fuse.Attr{
+		Inode: stat.Ino,            // inode number of the mirror file
+		Size:  uint64(finfo.Size()), // size in bytes
+		Uid:   stat.Uid,             // owner uid
+		Gid:   stat.Gid,             // group gid
+		Mode:  finfo.Mode(),         // file mode, including the symlink bit
+		Atime: now,                  // time of last access
+		Mtime: finfo.ModTime(),      // time of last modification
+		// Ctime: now,               // time of last inode change
+		// Crtime: now,              // time of creation (OS X only)
+		// Nlink: 1,                 // number of links (usually 1)
+
+		// Rdev: 0,                  // device numbers
+		// Flags: 0,                 // chflags(2) flags (OS X only)
+		// Blocks: 0,                // size in 512-byte units
+		// BlockSize: 512,           // size of blocks on disk
+	}
+
+	if n.fs.overlay != nil && finfo.Mode().IsRegular() {
+		// The mirror holds the ciphertext size; report the plaintext size.
+		attr.Size = uint64(crypto.PlainSize(finfo.Size()))
+	}
+	return attr
+}
+
+// decodeName translates a mirror-side file name back to the plaintext
+// name Lookup/ReadDirAll should report, or false if it isn't one of ours
+// (e.g. the encrypting overlay's own key config file sitting at the
+// mirror root).
+func (n *Node) decodeName(raw string) (string, bool) {
+	return n.fs.decodeName(raw)
+}
+
 // Attr implements the fuse.Node interface (also used for Getattr)
 func (n *Node) Attr(ctx context.Context, attr *fuse.Attr) error {
 	trace("Attr %s", n.path)
 
-	now := time.Now()
+	if cached, ok := n.fs.cache.attr(n.path); ok {
+		*attr = cached
+		return nil
+	}
+
 	finfo, stat, err := n.info()
 	if err != nil {
 		return errno(err)
 	}
 
-	attr.Inode = stat.Ino            // inode number -- currently unknown
-	attr.Size = uint64(finfo.Size()) // size in bytes
-	attr.Uid = stat.Uid              // owner uid
-	attr.Gid = stat.Gid              // group gid
-	attr.Mode = finfo.Mode()         // file mode
-	attr.Atime = now                 // time of last access
-	attr.Mtime = finfo.ModTime()     // time of last modification
-	// attr.Ctime = now             // time of last inode change
-	// attr.Crtime = now            // time of creation (OS X only)
-	// attr.Nlink = 1               // number of links (usually 1)
-
-	// attr.Rdev = 0                // device numbers
-	// attr.Flags = 0               // chflags(2) flags (OS X only)
-	// attr.Blocks = 0              // size in 512-byte units
-	// attr.BlockSize = 512         // size of blocks on disk
-
+	*attr = n.buildAttr(finfo, stat, time.Now())
+	n.fs.cache.storeAttr(n.path, *attr)
 	return nil
 }
 
@@ -95,7 +141,17 @@ func (n *Node) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 		// Truncate the node if it's a file.
 		if !finfo.IsDir() {
 			debug("truncating %s to %d", n.path, req.Size)
-			if err := os.Truncate(n.mirrorPath(), int64(req.Size)); err != nil {
+
+			var err error
+			if n.fs.overlay != nil {
+				// Re-seal the boundary block rather than just truncating
+				// the raw ciphertext, or its AEAD tag would no longer
+				// match.
+				err = n.fs.overlay.Truncate(n.mirrorPath(), int64(req.Size))
+			} else {
+				err = os.Truncate(n.mirrorPath(), int64(req.Size))
+			}
+			if err != nil {
 				return errno(err)
 			}
 		} else {
@@ -180,6 +236,9 @@ func (n *Node) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 		debug("ignoring setting flags on node %d", n.path)
 	}
 
+	// The cached attr is now stale; drop it before recomputing.
+	n.fs.cache.forget(n.path)
+
 	// VERY IMPORANT! Set the new attrs on the response!
 	return n.Attr(ctx, &resp.Attr)
 }
@@ -199,11 +258,22 @@ func (n *Node) Lookup(ctx context.Context, name string) (fs.Node, error) {
 		return nil, errno(err)
 	}
 
-	// Check to ensure the path exists in mirror
-	if !pathExists(node.mirrorPath()) {
+	// Consult the parent's cached directory listing before hitting disk.
+	if ents, ok := n.fs.cache.dirents(n.path); ok {
+		for _, ent := range ents {
+			if ent.Name == name {
+				return node, nil
+			}
+		}
 		return nil, fuse.ENOENT
 	}
 
+	// Check to ensure the path exists in mirror, using Lstat so that
+	// symlinks are found even when their target is missing.
+	if _, err := os.Lstat(node.mirrorPath()); err != nil {
+		return nil, errno(err)
+	}
+
 	return node, nil
 }
 
@@ -211,6 +281,10 @@ func (n *Node) Lookup(ctx context.Context, name string) (fs.Node, error) {
 func (n *Node) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	trace("ReadDirAll %s", n.path)
 
+	if ents, ok := n.fs.cache.dirents(n.path); ok {
+		return ents, nil
+	}
+
 	// List the contents of the mirror path
 	finfos, err := ioutil.ReadDir(n.mirrorPath())
 	if err != nil {
@@ -218,18 +292,25 @@ func (n *Node) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	}
 
 	// Create the listing response
-	ents := make([]fuse.Dirent, len(finfos))
+	ents := make([]fuse.Dirent, 0, len(finfos))
 
 	// Return fuse directory entities for listing
-	for idx, finfo := range finfos {
+	for _, finfo := range finfos {
+		name, ok := n.decodeName(finfo.Name())
+		if !ok {
+			continue
+		}
+
 		stat := finfo.Sys().(*syscall.Stat_t)
-		ents[idx] = fuse.Dirent{
+		ents = append(ents, fuse.Dirent{
 			Inode: stat.Ino,
 			Type:  fuseType(finfo),
-			Name:  finfo.Name(),
-		}
+			Name:  name,
+		})
 	}
 
+	n.fs.cache.storeDirents(n.path, ents)
+
 	return ents, nil
 }
 
@@ -250,6 +331,13 @@ func (n *Node) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, erro
 
 	// Chown the mirror directory according to the Uid and Gid of the caller
 	os.Chown(dir.mirrorPath(), int(req.Header.Uid), int(req.Header.Gid))
+
+	// Watch the new directory too, or out-of-band changes under it would
+	// never be noticed.
+	n.fs.watchDir(dir.mirrorPath())
+
+	// The parent's cached listing is now stale.
+	n.fs.cache.forget(n.path)
 	return dir, nil
 }
 
@@ -258,31 +346,61 @@ func (n *Node) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.C
 	trace("Create %s in %s", req.Name, n.path)
 
 	// Create the file node in the mount path
-	var err error
-	f, err := n.fs.makeNode(filepath.Join(n.path, req.Name))
+	node, err := n.fs.makeNode(filepath.Join(n.path, req.Name))
 	if err != nil {
 		return nil, nil, errno(err)
 	}
 
-	// Open a handle to the file in the mirror path
-	f.file, err = os.OpenFile(f.mirrorPath(), int(req.Flags), req.Mode)
+	// Open a handle to the file in the mirror path with the flags the
+	// caller asked for, which the Handle keeps as-is; see openContent for
+	// how O_APPEND and write-only opens reach the mirror file.
+	file, err := n.fs.openContent(node.mirrorPath(), req.Flags, req.Mode)
 	if err != nil {
 		return nil, nil, errno(err)
 	}
 
-	// The node acts as an open file handle as well
-	return f, f, nil
+	h := &Handle{node: node, file: file, flags: req.Flags}
+
+	// The parent's cached listing is now stale.
+	n.fs.cache.forget(n.path)
+	return node, h, nil
+}
+
+// Open implements fuse.NodeOpener so that reads and writes go through an
+// explicit open rather than being lazily triggered inside Read/Write.
+func (n *Node) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	trace("Open %s flags %s", n.path, req.Flags)
+
+	info, _, err := n.info()
+	if err != nil {
+		return nil, errno(err)
+	}
+
+	// Open the file with the flags the caller requested, which the Handle
+	// keeps as-is; see openContent for how O_APPEND and write-only opens
+	// reach the mirror file.
+	file, err := n.fs.openContent(n.mirrorPath(), req.Flags, info.Mode())
+	if err != nil {
+		return nil, errno(err)
+	}
+
+	h := &Handle{node: n, file: file, flags: req.Flags}
+	return h, nil
 }
 
 // Remove implements fuse.NodeRemover
 func (n *Node) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
 	trace("Remove %s from %s", req.Name, n.path)
 
-	path := filepath.Join(n.mirrorPath(), req.Name)
+	path := n.childMirrorPath(req.Name)
 	if err := os.Remove(path); err != nil {
 		return errno(err)
 	}
 
+	// The parent's cached listing and the removed node's cached attr are
+	// now stale.
+	n.fs.cache.forget(n.path)
+	n.fs.cache.forget(filepath.Join(n.path, req.Name))
 	return nil
 }
 
@@ -295,125 +413,19 @@ func (n *Node) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.No
 	trace("Rename %s from %s to %s in %s", req.OldName, n.path, req.NewName, d.path)
 
 	// Compute the source and destination paths for rename
-	src := filepath.Join(n.mirrorPath(), req.OldName)
-	dst := filepath.Join(d.mirrorPath(), req.NewName)
+	src := n.childMirrorPath(req.OldName)
+	dst := d.childMirrorPath(req.NewName)
 
 	if err := os.Rename(src, dst); err != nil {
 		return errno(err)
 	}
 
+	// Both the source and destination directory listings are now stale,
+	// along with whatever was cached for the renamed node itself.
+	n.fs.cache.forget(n.path)
+	n.fs.cache.forget(d.path)
+	n.fs.cache.forget(filepath.Join(n.path, req.OldName))
 	return nil
 }
 
-//===========================================================================
-// File Node Methods
-//===========================================================================
-
-// Read implements fuse.HandleReader
-func (n *Node) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
-	trace("Read %s", n.path)
-
-	if n.file == nil {
-		// Find the mode of the file
-		var info os.FileInfo
-		info, err = os.Stat(n.mirrorPath())
-		if err != nil {
-			return errno(err)
-		}
-
-		// Open the file with the specified read flags
-		n.file, err = os.OpenFile(n.mirrorPath(), int(req.FileFlags), info.Mode())
-		if err != nil {
-			return errno(err)
-		}
-	}
-
-	resp.Data = make([]byte, req.Size)
-	nbytes, err := n.file.ReadAt(resp.Data, req.Offset)
-	if err != nil {
-		if err != io.EOF {
-			return errno(err)
-		}
-
-		// Otherwise modify the response to the exact length
-		resp.Data = resp.Data[0:nbytes]
-	}
-
-	debug("read %d bytes from offest %d in %s", nbytes, req.Offset, n.path)
-	return nil
-}
-
-// Write implements fuse.HandleWriter
-func (n *Node) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
-	trace("Write %s", n.path)
-
-	if n.file == nil {
-		// Find the mode of the file
-		var info os.FileInfo
-		info, err = os.Stat(n.mirrorPath())
-		if err != nil {
-			return errno(err)
-		}
-
-		// Open the file with the specified read flags
-		n.file, err = os.OpenFile(n.mirrorPath(), int(req.FileFlags), info.Mode())
-		if err != nil {
-			return errno(err)
-		}
-	}
-
-	// Write the data to the file
-	resp.Size, err = n.file.WriteAt(req.Data, req.Offset)
-	if err != nil {
-		// TODO: when appending to a file currently getting a bad file
-		// descriptor error. It appears that the append flag is not being set
-		// which seems like a bug ...
-		return errno(err)
-	}
-
-	debug("wrote %d bytes offset by %d to %s", resp.Size, req.Offset, n.path)
-	return nil
-}
-
-// Fsync implements fuse.HandleFsyncer
-func (n *Node) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
-	trace("Fsync %s", n.path)
-
-	// fsync tells the OS to flush its buffers to the physical media
-	if n.file != nil {
-		if err := n.file.Sync(); err != nil {
-			return errno(err)
-		}
-	}
-	return nil
-}
-
-// Flush implments fuse.HandleFlusher
-func (n *Node) Flush(ctx context.Context, req *fuse.FlushRequest) error {
-	trace("Flush %s", n.path)
-
-	// flush the internal buffers of your application out to the OS
-	debug("flush not implemented as there are no internal buffers")
-	return nil
-}
-
-// Release implements fuse.HandleReleaser
-func (n *Node) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
-	trace("Release %s", n.path)
-
-	if n.file != nil {
-		if req.ReleaseFlags == fuse.ReleaseFlush {
-			if err := n.file.Sync(); err != nil {
-				caution(err.Error())
-			}
-		}
-
-		if err := n.file.Close(); err != nil {
-			caution(err.Error())
-		}
-
-		// Ensure the handle is set to nil when closed successfully
-		n.file = nil
-	}
-	return nil
-}
+// File contents are read and written through *Handle, see handle.go.
@@ -0,0 +1,72 @@
+package mirrorfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+//===========================================================================
+// Symlink and Hardlink Node Methods
+//===========================================================================
+
+// Readlink implements the fuse.NodeReadlinker interface.
+func (n *Node) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	trace("Readlink %s", n.path)
+
+	target, err := os.Readlink(n.mirrorPath())
+	if err != nil {
+		return "", errno(err)
+	}
+
+	return target, nil
+}
+
+// Symlink implements the fuse.NodeSymlinker interface.
+func (n *Node) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	trace("Symlink %s -> %s in %s", req.NewName, req.Target, n.path)
+
+	link, err := n.fs.makeNode(filepath.Join(n.path, req.NewName))
+	if err != nil {
+		return nil, errno(err)
+	}
+
+	if err := os.Symlink(req.Target, link.mirrorPath()); err != nil {
+		return nil, errno(err)
+	}
+
+	// Lchown the mirror symlink itself (not its target) according to the
+	// Uid and Gid of the caller.
+	os.Lchown(link.mirrorPath(), int(req.Header.Uid), int(req.Header.Gid))
+
+	// The parent's cached listing is now stale.
+	n.fs.cache.forget(n.path)
+	return link, nil
+}
+
+// Link implements the fuse.NodeLinker interface.
+func (n *Node) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.Node, error) {
+	src, ok := old.(*Node)
+	if !ok {
+		return nil, errors.New("could not convert fs.Node to a mirrorfs.Node")
+	}
+	trace("Link %s from %s to %s", req.NewName, src.path, n.path)
+
+	link, err := n.fs.makeNode(filepath.Join(n.path, req.NewName))
+	if err != nil {
+		return nil, errno(err)
+	}
+
+	if err := os.Link(src.mirrorPath(), link.mirrorPath()); err != nil {
+		return nil, errno(err)
+	}
+
+	// The parent's cached listing is now stale.
+	n.fs.cache.forget(n.path)
+	return link, nil
+}
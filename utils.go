@@ -31,18 +31,20 @@ func errno(err error) fuse.Errno {
 		return fuse.EPERM
 	}
 
+	if isNoXattrErr(err) {
+		debug(err.Error())
+		return fuse.ErrNoXattr
+	}
+
 	warne(err) // Unknown error has occurred
 	return fuse.DefaultErrno
 }
 
-// Checks to see if a path exists
-func pathExists(path string) bool {
-	_, err := os.Stat(path)
-	return !os.IsNotExist(err)
-}
-
 // Returns the fuse type from a stat response
 func fuseType(info os.FileInfo) fuse.DirentType {
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fuse.DT_Link
+	}
 	if info.IsDir() {
 		return fuse.DT_Dir
 	}
@@ -0,0 +1,94 @@
+// +build darwin
+
+package mirrorfs
+
+import (
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+
+	"bazil.org/fuse"
+)
+
+//===========================================================================
+// Extended Attribute Node Methods (Darwin)
+//===========================================================================
+
+// Getxattr implements the fuse.NodeGetxattrer interface. Go's standard
+// syscall package doesn't expose xattr syscalls on darwin at all, so these
+// go through golang.org/x/sys/unix instead.
+func (n *Node) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	trace("Getxattr %s on %s", req.Name, n.path)
+
+	if req.Size == 0 {
+		// The kernel is only probing for the size of the attribute.
+		sz, err := unix.Getxattr(n.mirrorPath(), req.Name, nil)
+		if err != nil {
+			return errno(err)
+		}
+
+		resp.Xattr = make([]byte, sz)
+		return nil
+	}
+
+	buf := make([]byte, req.Size)
+	sz, err := unix.Getxattr(n.mirrorPath(), req.Name, buf)
+	if err != nil {
+		return errno(err)
+	}
+
+	resp.Xattr = buf[:sz]
+	return nil
+}
+
+// Setxattr implements the fuse.NodeSetxattrer interface.
+func (n *Node) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	trace("Setxattr %s on %s", req.Name, n.path)
+
+	if err := unix.Setxattr(n.mirrorPath(), req.Name, req.Xattr, int(req.Flags)); err != nil {
+		return errno(err)
+	}
+
+	return nil
+}
+
+// Listxattr implements the fuse.NodeListxattrer interface.
+func (n *Node) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	trace("Listxattr %s", n.path)
+
+	// Call once with a nil buffer to discover how large the NUL-split name
+	// list is, then call again with a buffer of that size to fetch it.
+	sz, err := unix.Listxattr(n.mirrorPath(), nil)
+	if err != nil {
+		return errno(err)
+	}
+
+	if sz == 0 {
+		return nil
+	}
+
+	buf := make([]byte, sz)
+	sz, err = unix.Listxattr(n.mirrorPath(), buf)
+	if err != nil {
+		return errno(err)
+	}
+
+	resp.Xattr = buf[:sz]
+	return nil
+}
+
+// Removexattr implements the fuse.NodeRemovexattrer interface.
+func (n *Node) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	trace("Removexattr %s on %s", req.Name, n.path)
+
+	if err := unix.Removexattr(n.mirrorPath(), req.Name); err != nil {
+		return errno(err)
+	}
+
+	return nil
+}
+
+// isNoXattrErr reports whether err is the platform's "no such attribute"
+// error so that errno() can translate it to fuse.ErrNoXattr.
+func isNoXattrErr(err error) bool {
+	return err == unix.ENOATTR
+}